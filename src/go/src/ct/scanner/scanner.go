@@ -2,22 +2,129 @@ package scanner
 
 import (
 	"bytes"
+	"container/heap"
 	"container/list"
+	"context"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"ct"
 	"ct/client"
+	"encoding/asn1"
 	"fmt"
 	"log"
+	"math/rand"
 	"regexp"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ctPoisonOID is the OID of the CT "poison" critical extension that every
+// precertificate's TBSCertificate carries, per RFC 6962 section 3.1. It must
+// be stripped before the TBSCertificate can be re-assembled into something
+// x509.ParseCertificate() will accept.
+var ctPoisonOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+// tbsCertificate is a re-declaration of the RFC 5280 TBSCertificate ASN.1
+// structure, sufficient to let us drop the poison extension and re-marshal
+// the result. We can't reuse crypto/x509's (unexported) equivalent.
+type tbsCertificate struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	Issuer             asn1.RawValue
+	Validity           asn1.RawValue
+	Subject            asn1.RawValue
+	PublicKey          asn1.RawValue
+	UniqueId           asn1.BitString   `asn1:"optional,tag:1"`
+	SubjectUniqueId    asn1.BitString   `asn1:"optional,tag:2"`
+	Extensions         []pkix.Extension `asn1:"optional,explicit,tag:3"`
+}
+
+// wrappedCertificate is the outer RFC 5280 Certificate ASN.1 SEQUENCE. We
+// build one of these around a (poison-stripped) precert TBSCertificate so
+// that x509.ParseCertificate() has something shaped like a real certificate
+// to parse; the signature itself is never verified by Scanner.
+type wrappedCertificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	SignatureValue     asn1.BitString
+}
+
+// stripPoisonExtension removes the CT poison extension from a raw, DER
+// encoded precert TBSCertificate, and returns the re-marshaled result.
+func stripPoisonExtension(rawTBS []byte) ([]byte, error) {
+	var tbs tbsCertificate
+	if _, err := asn1.Unmarshal(rawTBS, &tbs); err != nil {
+		return nil, fmt.Errorf("failed to parse precert TBSCertificate: %s", err.Error())
+	}
+	kept := tbs.Extensions[:0]
+	for _, ext := range tbs.Extensions {
+		if !ext.Id.Equal(ctPoisonOID) {
+			kept = append(kept, ext)
+		}
+	}
+	tbs.Extensions = kept
+	tbs.Raw = nil
+	out, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-marshal precert TBSCertificate: %s", err.Error())
+	}
+	return out, nil
+}
+
+// parsePrecert reconstructs a parseable *x509.Certificate from the PreCert
+// embedded in a precertificate's TimestampedEntry, so that it can be run
+// through the same Matcher used for ordinary X509 entries. The CT poison
+// extension is stripped before re-serializing, and the issuer key hash
+// carried alongside the TBSCertificate is recorded as the reconstructed
+// certificate's AuthorityKeyId, since the real issuing certificate isn't
+// available to us here.
+//
+// Returns the reconstructed certificate, and the (poison-stripped) raw TBS
+// bytes it was built from.
+func parsePrecert(p client.PreCert) (*x509.Certificate, []byte, error) {
+	tbs, err := stripPoisonExtension(p.TBSCertificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	var inner tbsCertificate
+	if _, err := asn1.Unmarshal(tbs, &inner); err != nil {
+		return nil, nil, fmt.Errorf("failed to re-parse stripped precert TBSCertificate: %s", err.Error())
+	}
+	certDER, err := asn1.Marshal(wrappedCertificate{
+		TBSCertificate:     asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: inner.SignatureAlgorithm,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap precert TBSCertificate: %s", err.Error())
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse reconstructed precert: %s", err.Error())
+	}
+	if len(p.IssuerKeyHash) > 0 {
+		cert.AuthorityKeyId = p.IssuerKeyHash[:]
+	}
+	return cert, tbs, nil
+}
+
 // Function prototype for matcher functions:
 type Matcher interface {
 	CertificateMatches(*x509.Certificate) bool
 }
 
+// LeafMatcher is a lower-level alternative to Matcher: it's handed the fully
+// parsed log entry -- including its SCT timestamp, extensions, and raw leaf
+// bytes -- before any x509 parsing happens. This lets callers filter on
+// things like timestamp ranges or entry type without paying the cost of
+// parsing a certificate out of every single leaf.
+type LeafMatcher interface {
+	Matches(*client.LogEntry) bool
+}
+
 type MatchAll struct{}
 
 func (m MatchAll) CertificateMatches(_ *x509.Certificate) bool {
@@ -48,9 +155,11 @@ func (m MatchSubjectRegex) CertificateMatches(c *x509.Certificate) bool {
 
 // ScannerOptions holds configuration options for the Scanner
 type ScannerOptions struct {
-	// Custom matcher for x509 Certificates, functor will be called for each
-	// Certificate found during scanning.
-	Matcher Matcher
+	// Custom matcher, called for each entry found during scanning. May hold
+	// either a Matcher (examines the parsed x509 Certificate or precert) or
+	// a LeafMatcher (examines the raw, parsed log entry ahead of x509
+	// parsing), or something implementing both. Defaults to MatchAll.
+	Matcher interface{}
 
 	// Number of entries to request in one batch from the Log
 	BlockSize int
@@ -63,12 +172,57 @@ type ScannerOptions struct {
 
 	// Log entry index to start fetching & matching at
 	StartIndex int64
+
+	// If true, don't pay the cost of parsing X509 entries at all -- only
+	// precerts will be matched and passed to foundPrecert.
+	PrecertOnly bool
+
+	// Controls retry/backoff behaviour for failed GetEntries calls.
+	Fetcher FetcherOptions
+
+	// If true, fold every fetched entry's leaf hash into an incremental
+	// Merkle tree and verify it against TrustedSTH via a consistency proof
+	// as each chunk is delivered, rather than trusting the log's GetEntries
+	// response outright. A chunk whose delivery takes the tree past
+	// TrustedSTH's tree size is not verified, so entries beyond that size
+	// (and any earlier ones in the same chunk) are delivered unchecked.
+	VerifyInclusion bool
+
+	// The STH to verify against when VerifyInclusion is set. Required in
+	// that case; ignored otherwise.
+	TrustedSTH *ct.SignedTreeHead
+}
+
+// FetcherOptions controls how a Scanner retries a failed attempt to fetch a
+// range of entries from the Log.
+type FetcherOptions struct {
+	// Maximum number of attempts to make per range before giving up and
+	// reporting a hard failure. Zero (the default) retries forever, which
+	// matches the Scanner's historical behaviour.
+	MaxAttempts int
+
+	// Backoff before the first retry. Defaults to one second if zero.
+	InitialBackoff time.Duration
+
+	// Ceiling that the exponentially-increasing backoff is capped at.
+	// Random jitter of up to the current backoff is added on top of it, so
+	// an actual wait can be up to twice this. Defaults to 30 seconds if zero.
+	MaxBackoff time.Duration
+}
+
+// logClientAPI is the subset of *client.LogClient's methods that Scanner
+// depends on, broken out so tests can substitute a fake log server instead
+// of making real network calls. *client.LogClient satisfies it as-is.
+type logClientAPI interface {
+	GetEntries(start, end int64) ([]client.LeafInput, error)
+	GetSTH() (*ct.SignedTreeHead, error)
+	GetSTHConsistency(first, second int64) ([][]byte, error)
 }
 
 // Scanner is a tool to scan all the entries in a CT Log.
 type Scanner struct {
 	// Client used to talk to the CT log instance
-	logClient *client.LogClient
+	logClient logClientAPI
 
 	// Configuration options for this Scanner instance
 	opts ScannerOptions
@@ -78,6 +232,39 @@ type Scanner struct {
 
 	// Counter of the number of precertificates encountered during the scan.
 	precertsSeen int64
+
+	// Incremental Merkle tree accumulating the leaf hashes of every entry
+	// delivered so far, in log order. Only maintained when
+	// opts.VerifyInclusion is set; only ever touched from the single
+	// dispatchChunks goroutine, so needs no locking of its own.
+	incTree compactMerkleTree
+}
+
+// fetchRange represents a range of certs to fetch from a CT log
+type fetchRange struct {
+	start int64
+	end   int64
+}
+
+// entryMatch records what (if anything) should be delivered for a single log
+// entry, once the chunk it belongs to reaches the front of the dispatch
+// order.
+type entryMatch struct {
+	index    int64
+	cert     *x509.Certificate // set: foundCert should fire with this
+	precert  *x509.Certificate // set: foundPrecert should fire with this
+	rawTBS   []byte
+	leafHash [32]byte // RFC 6962 leaf hash of the entry's raw MerkleTreeLeaf
+}
+
+// chunkResult accumulates the match results for every entry in a fetchRange.
+// Matcher workers fill in |matches| as they finish individual entries; once
+// |remaining| hits zero the chunk is complete and ready to be handed to the
+// dispatcher.
+type chunkResult struct {
+	start     int64
+	matches   []entryMatch
+	remaining int32
 }
 
 // matcherJob represents the context for an individual matcher job.
@@ -86,80 +273,487 @@ type matcherJob struct {
 	leaf client.LeafInput
 	// The index of the entry containing the LeafInput in the log
 	index int64
+	// The chunk this entry belongs to, and its slot within it.
+	chunk *chunkResult
+	slot  int
 }
 
-// fetchRange represents a range of certs to fetch from a CT log
-type fetchRange struct {
-	start int64
-	end   int64
+// chunkHeap is a min-heap of not-yet-dispatched chunkResults, ordered by
+// start index, used to reassemble chunks into strict log order regardless
+// of which fetcher/matcher finished them first.
+type chunkHeap []*chunkResult
+
+func (h chunkHeap) Len() int            { return len(h) }
+func (h chunkHeap) Less(i, j int) bool  { return h[i].start < h[j].start }
+func (h chunkHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *chunkHeap) Push(x interface{}) { *h = append(*h, x.(*chunkResult)) }
+func (h *chunkHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// chunkDispatcher delivers completed chunks to the caller's callbacks in
+// strict log order: it only pops and delivers the chunk at the top of the
+// heap once its start index is the next one expected, so a crash-safe
+// "processed through" watermark can be derived from onProgress.
+type chunkDispatcher struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	heap      chunkHeap
+	next      int64
+	remaining int
+	cancelled bool
+}
+
+func newChunkDispatcher(start int64, numChunks int) *chunkDispatcher {
+	d := &chunkDispatcher{next: start, remaining: numChunks}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// push adds a completed chunk to the heap for the dispatcher to consider.
+func (d *chunkDispatcher) push(c *chunkResult) {
+	d.mu.Lock()
+	heap.Push(&d.heap, c)
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// cancel unblocks pop() even if some promised chunks never arrive.
+func (d *chunkDispatcher) cancel() {
+	d.mu.Lock()
+	d.cancelled = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// pop blocks until the chunk with the next expected start index is
+// available, then returns it. Returns ok == false once every promised chunk
+// has been returned, or cancel() has been called and the next expected
+// chunk isn't already sitting in the heap ready to go -- cancel() only
+// stops pop() waiting on chunks that are never coming, it doesn't throw
+// away ones that already arrived.
+func (d *chunkDispatcher) pop() (c *chunkResult, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for !d.cancelled && d.remaining > 0 && (len(d.heap) == 0 || d.heap[0].start != d.next) {
+		d.cond.Wait()
+	}
+	if len(d.heap) == 0 || d.heap[0].start != d.next {
+		return nil, false
+	}
+	c = heap.Pop(&d.heap).(*chunkResult)
+	d.remaining--
+	d.next = c.start + int64(len(c.matches))
+	return c, true
 }
 
-// Processes the given |leafInput| found at |index| in the specified log.
-func (s *Scanner) processEntry(index int64, leafInput client.LeafInput, foundCert func(int64, *x509.Certificate), foundPrecert func(int64, string)) {
+// Matches the given |leafInput| found at |index| in the specified log,
+// returning the result rather than invoking any callback directly -- the
+// caller is responsible for delivering it in log order. The entry's RFC 6962
+// leaf hash is always computed, regardless of whether it matches, so that
+// VerifyInclusion can fold it into the running Merkle tree.
+func (s *Scanner) matchEntry(index int64, leafInput client.LeafInput) (m entryMatch) {
+	m.index = index
+	m.leafHash = rfc6962LeafHash(leafInput)
+
 	atomic.AddInt64(&s.certsProcessed, 1)
 	leaf, err := client.NewMerkleTreeLeaf(bytes.NewBuffer(leafInput))
 	if err != nil {
 		log.Printf("Failed to parse MerkleTreeLeaf at index %d : %s", index, err.Error())
 		return
 	}
+
+	if lm, ok := s.opts.Matcher.(LeafMatcher); ok {
+		entry := &client.LogEntry{Index: index, Leaf: *leaf, Raw: leafInput}
+		if !lm.Matches(entry) {
+			return
+		}
+	}
+	cm, hasCertMatcher := s.opts.Matcher.(Matcher)
+
 	switch leaf.TimestampedEntry.EntryType {
 	case client.X509LogEntryType:
+		if s.opts.PrecertOnly {
+			return
+		}
 		cert, err := x509.ParseCertificate(leaf.TimestampedEntry.X509Entry)
 		if err != nil {
 			log.Printf("Failed to parse cert at index %d : %s", index, err.Error())
 			return
 		}
-		if s.opts.Matcher.CertificateMatches(cert) {
-			foundCert(index, cert)
+		if !hasCertMatcher || cm.CertificateMatches(cert) {
+			m.cert = cert
 		}
 	case client.PrecertLogEntryType:
-		log.Printf("Precert not yet supported (index %d).", index)
-		foundPrecert(index, "")
 		s.precertsSeen++
+		precert, rawTBS, err := parsePrecert(leaf.TimestampedEntry.PrecertEntry)
+		if err != nil {
+			log.Printf("Failed to parse precert at index %d : %s", index, err.Error())
+			return
+		}
+		if !hasCertMatcher || cm.CertificateMatches(precert) {
+			m.precert = precert
+			m.rawTBS = rawTBS
+		}
+	}
+	return
+}
+
+// rfc6962LeafHash computes the RFC 6962 section 2.1 hash of a Merkle tree
+// leaf, given the raw, serialized MerkleTreeLeaf bytes the log returned for
+// it.
+func rfc6962LeafHash(leaf client.LeafInput) [32]byte {
+	return sha256.Sum256(append([]byte{0x00}, leaf...))
+}
+
+// rfc6962NodeHash computes the RFC 6962 section 2.1 hash of an interior
+// Merkle tree node from the hashes of its two children.
+func rfc6962NodeHash(left, right [32]byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left[:])
+	h.Write(right[:])
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// to32 copies a hash returned over the wire (e.g. a consistency proof node,
+// or an STH root) into a [32]byte so it can be compared and hashed by value.
+func to32(b []byte) [32]byte {
+	var h [32]byte
+	copy(h[:], b)
+	return h
+}
+
+// compactMerkleTreeNode is one entry of a compactMerkleTree's stack: the
+// hash of a complete subtree of 2^level leaves.
+type compactMerkleTreeNode struct {
+	level int
+	hash  [32]byte
+}
+
+// compactMerkleTree incrementally accumulates RFC 6962 leaf hashes appended
+// in log order, keeping only O(log size) node hashes -- the hashes of the
+// complete subtrees ("peaks") that size decomposes into -- from which the
+// root of the tree seen so far can always be recomputed.
+type compactMerkleTree struct {
+	size  int64
+	stack []compactMerkleTreeNode
+}
+
+// addLeaf folds |hash| into the tree as its next (size-th) leaf.
+func (t *compactMerkleTree) addLeaf(hash [32]byte) {
+	t.stack = append(t.stack, compactMerkleTreeNode{level: 0, hash: hash})
+	for len(t.stack) >= 2 && t.stack[len(t.stack)-1].level == t.stack[len(t.stack)-2].level {
+		right := t.stack[len(t.stack)-1]
+		left := t.stack[len(t.stack)-2]
+		t.stack = t.stack[:len(t.stack)-2]
+		t.stack = append(t.stack, compactMerkleTreeNode{
+			level: left.level + 1,
+			hash:  rfc6962NodeHash(left.hash, right.hash),
+		})
+	}
+	t.size++
+}
+
+// root returns the RFC 6962 Merkle Tree Hash of every leaf added so far, by
+// folding the peak stack (ordered largest/leftmost subtree first) from the
+// right, matching the recursive definition of MTH in RFC 6962 section 2.1.
+func (t *compactMerkleTree) root() [32]byte {
+	if len(t.stack) == 0 {
+		return sha256.Sum256(nil)
+	}
+	hash := t.stack[len(t.stack)-1].hash
+	for i := len(t.stack) - 2; i >= 0; i-- {
+		hash = rfc6962NodeHash(t.stack[i].hash, hash)
+	}
+	return hash
+}
+
+// verifyConsistency checks that |proof| is a valid RFC 6962 section 2.1.2
+// consistency proof between a tree of size |size1| with root hash |root1|
+// and a (larger or equal) tree of size |size2| with root hash |root2|.
+func verifyConsistency(size1, size2 int64, root1, root2 [32]byte, proof [][]byte) error {
+	if size1 > size2 {
+		return fmt.Errorf("size1 (%d) > size2 (%d)", size1, size2)
+	}
+	if size1 == size2 {
+		if len(proof) != 0 {
+			return fmt.Errorf("expected empty proof for equal tree sizes, got %d nodes", len(proof))
+		}
+		if root1 != root2 {
+			return fmt.Errorf("root hash mismatch for equal tree size %d", size1)
+		}
+		return nil
+	}
+	if size1 == 0 {
+		// Every tree is consistent with the empty tree.
+		if len(proof) != 0 {
+			return fmt.Errorf("expected empty proof when size1 is 0, got %d nodes", len(proof))
+		}
+		return nil
+	}
+	if len(proof) == 0 {
+		return fmt.Errorf("empty consistency proof for size1=%d, size2=%d", size1, size2)
+	}
+
+	node := size1 - 1
+	lastNode := size2 - 1
+	for node%2 == 1 {
+		node /= 2
+		lastNode /= 2
+	}
+
+	var newHash, oldHash [32]byte
+	if node > 0 {
+		newHash = to32(proof[0])
+		oldHash = newHash
+		proof = proof[1:]
+	} else {
+		newHash = root1
+		oldHash = root1
+	}
+
+	for _, raw := range proof {
+		h := to32(raw)
+		if lastNode == 0 {
+			return fmt.Errorf("consistency proof for size1=%d, size2=%d has extra nodes", size1, size2)
+		}
+		if node%2 == 1 || node == lastNode {
+			oldHash = rfc6962NodeHash(h, oldHash)
+			newHash = rfc6962NodeHash(h, newHash)
+			for node%2 == 0 && node != 0 {
+				node /= 2
+				lastNode /= 2
+			}
+		} else {
+			newHash = rfc6962NodeHash(newHash, h)
+		}
+		node /= 2
+		lastNode /= 2
+	}
+
+	if oldHash != root1 {
+		return fmt.Errorf("consistency proof for size1=%d, size2=%d does not resolve to the old root", size1, size2)
 	}
+	if newHash != root2 {
+		return fmt.Errorf("consistency proof for size1=%d, size2=%d does not resolve to the new root", size1, size2)
+	}
+	return nil
 }
 
 // Worker function to match certs.
-// Accepts MatcherJobs over the |entries| channel, and processes them.
-// Returns true over the |done| channel when the |entries| channel is closed.
-func (s *Scanner) matcherJob(id int, entries <-chan matcherJob, foundCert func(int64, *x509.Certificate), foundPrecert func(int64, string), wg *sync.WaitGroup) {
+// Accepts MatcherJobs over the |entries| channel, matches each one, and
+// files the result into its chunk. Once a chunk's last entry has been
+// matched, it's handed off to |dispatcher| for in-order delivery.
+func (s *Scanner) matcherJob(id int, entries <-chan matcherJob, dispatcher *chunkDispatcher, wg *sync.WaitGroup) {
 	for e := range entries {
-		s.processEntry(e.index, e.leaf, foundCert, foundPrecert)
+		e.chunk.matches[e.slot] = s.matchEntry(e.index, e.leaf)
+		if atomic.AddInt32(&e.chunk.remaining, -1) == 0 {
+			dispatcher.push(e.chunk)
+		}
 	}
 	log.Printf("Matcher %d finished", id)
 	wg.Done()
 }
 
+// validateOptions returns a descriptive error for option combinations that
+// would otherwise fail confusingly (or panic) partway through a scan,
+// instead of being rejected up front.
+func (s *Scanner) validateOptions() error {
+	if s.opts.VerifyInclusion && s.opts.TrustedSTH == nil {
+		return fmt.Errorf("opts.VerifyInclusion is set but opts.TrustedSTH is nil")
+	}
+	if s.opts.VerifyInclusion && s.opts.StartIndex != 0 {
+		// s.incTree always folds leaves starting from index 0 of the
+		// range being fetched, so its root is MTH(log[StartIndex:size]),
+		// not MTH(log[0:size]) -- it can't be checked against a
+		// consistency proof rooted at the start of the log. Properly
+		// supporting this requires accepting a trusted root at
+		// StartIndex to fold onto, rather than re-deriving a prefix root
+		// from scratch.
+		return fmt.Errorf("opts.VerifyInclusion is not supported with a non-zero opts.StartIndex (%d)", s.opts.StartIndex)
+	}
+	return nil
+}
+
+// proofFetchError wraps a transport-level failure fetching a consistency
+// proof from the log, as distinct from checkConsistency actually completing
+// the check and finding a root hash mismatch. scanRange treats the two
+// differently: a fetch failure is a hard error (the log might be fine, we
+// just couldn't ask it), while a mismatch is routed through foundInvalid.
+type proofFetchError struct {
+	err error
+}
+
+func (e *proofFetchError) Error() string { return e.err.Error() }
+func (e *proofFetchError) Unwrap() error { return e.err }
+
+// checkConsistency verifies that the root of s.incTree -- every leaf hash
+// folded in so far, in log order -- is consistent with opts.TrustedSTH, by
+// fetching a consistency proof between the two tree sizes from the log. It's
+// a no-op while s.incTree is empty, and once s.incTree has grown past
+// opts.TrustedSTH's tree size.
+// Callers must only invoke this once validateOptions has confirmed
+// opts.TrustedSTH is set. Returns a *proofFetchError if the log couldn't be
+// reached, as opposed to an ordinary error once it's actually been checked.
+func (s *Scanner) checkConsistency() error {
+	sth := s.opts.TrustedSTH
+	size, trustedSize := s.incTree.size, int64(sth.TreeSize)
+	if size == 0 || size > trustedSize {
+		return nil
+	}
+	if size == trustedSize {
+		if s.incTree.root() != sth.SHA256RootHash {
+			return fmt.Errorf("root hash mismatch at tree size %d", size)
+		}
+		return nil
+	}
+	proof, err := s.logClient.GetSTHConsistency(size, trustedSize)
+	if err != nil {
+		return &proofFetchError{fmt.Errorf("failed to fetch consistency proof [%d, %d]: %s", size, trustedSize, err.Error())}
+	}
+	return verifyConsistency(size, trustedSize, s.incTree.root(), sth.SHA256RootHash, proof)
+}
+
+// deliverChunk folds |c|'s entries into s.incTree and checks the result
+// against opts.TrustedSTH (when opts.VerifyInclusion is set), then invokes
+// the appropriate callback for every entry in the chunk, in order. If
+// verification actually ran and found a mismatch, every entry in the chunk
+// is reported through foundInvalid instead of foundCert/foundPrecert -- a
+// log serving a split view could have lied about any of them. If the
+// consistency proof itself couldn't be fetched, that's a transport failure
+// rather than evidence of a split view, so it's returned as a hard error
+// instead and nothing in the chunk is delivered.
+func (s *Scanner) deliverChunk(c *chunkResult, foundCert func(int64, *x509.Certificate), foundPrecert func(int64, *x509.Certificate, []byte), foundInvalid func(int64, error), onProgress func(int64)) error {
+	var verifyErr error
+	if s.opts.VerifyInclusion {
+		for _, m := range c.matches {
+			s.incTree.addLeaf(m.leafHash)
+		}
+		if err := s.checkConsistency(); err != nil {
+			if pfe, ok := err.(*proofFetchError); ok {
+				return pfe
+			}
+			verifyErr = err
+		}
+	}
+	for _, m := range c.matches {
+		switch {
+		case verifyErr != nil:
+			foundInvalid(m.index, verifyErr)
+		case m.cert != nil:
+			foundCert(m.index, m.cert)
+		case m.precert != nil:
+			foundPrecert(m.index, m.precert, m.rawTBS)
+		}
+	}
+	if onProgress != nil {
+		onProgress(c.start + int64(len(c.matches)) - 1)
+	}
+	return nil
+}
+
+// dispatchChunks pops completed chunks off |dispatcher| in strict log order
+// and delivers each one via deliverChunk, until the dispatcher reports there
+// are no more chunks coming (every chunk was delivered, or it was
+// cancelled), or deliverChunk reports a hard failure, in which case it's
+// pushed onto |errs| for scanRange to surface, same as a fetcher failure.
+func (s *Scanner) dispatchChunks(dispatcher *chunkDispatcher, foundCert func(int64, *x509.Certificate), foundPrecert func(int64, *x509.Certificate, []byte), foundInvalid func(int64, error), onProgress func(int64), errs chan<- error) {
+	for {
+		c, ok := dispatcher.pop()
+		if !ok {
+			return
+		}
+		if err := s.deliverChunk(c, foundCert, foundPrecert, foundInvalid, onProgress); err != nil {
+			errs <- err
+			return
+		}
+	}
+}
+
+// retryAfter extracts a log-supplied Retry-After delay from a GetEntries
+// error, if the log surfaced one (e.g. in response to an HTTP 429).
+func retryAfter(err error) (time.Duration, bool) {
+	if rspErr, ok := err.(client.RspError); ok && rspErr.Retry > 0 {
+		return rspErr.Retry, true
+	}
+	return 0, false
+}
+
+// fetchWithRetry calls GetEntries, retrying failed attempts with
+// exponential backoff and jitter. It honors any Retry-After the log
+// surfaced, gives up after opts.Fetcher.MaxAttempts attempts (unless that's
+// zero, meaning retry forever), and returns promptly if |ctx| is cancelled.
+func (s *Scanner) fetchWithRetry(ctx context.Context, start, end int64) ([]client.LeafInput, error) {
+	opts := s.opts.Fetcher
+	backoff := opts.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := opts.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		leaves, err := s.logClient.GetEntries(start, end)
+		if err == nil {
+			return leaves, nil
+		}
+		log.Printf("Problem fetching entries [%d, %d]: %s", start, end, err.Error())
+		if opts.MaxAttempts > 0 && attempt >= opts.MaxAttempts {
+			return nil, fmt.Errorf("giving up fetching entries [%d, %d] after %d attempts: %s", start, end, attempt, err.Error())
+		}
+		wait := backoff
+		if ra, ok := retryAfter(err); ok {
+			wait = ra
+		} else {
+			wait += time.Duration(rand.Int63n(int64(backoff) + 1))
+			backoff = minDuration(backoff*2, maxBackoff)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
 // Worker function for fetcher jobs.
 // Accepts cert ranges to fetch over the |ranges| channel, and if the fetch is
 // successful sends the individual LeafInputs out (as MatcherJobs) into the
 // |entries| channel for the matchers to chew on.
-// Will retry failed attempts to retrieve ranges indefinitely.
-// Sends true over the |done| channel when the |ranges| channel is closed.
-func (s *Scanner) fetcherJob(id int, ranges <-chan fetchRange, entries chan<- matcherJob, wg *sync.WaitGroup) {
+// Retries failed attempts per FetcherOptions; if a range can't be fetched
+// (MaxAttempts exceeded, or |ctx| cancelled) the error is sent to |errs| and
+// this fetcher stops, rather than spinning forever.
+func (s *Scanner) fetcherJob(ctx context.Context, id int, ranges <-chan fetchRange, entries chan<- matcherJob, errs chan<- error, wg *sync.WaitGroup) {
+	defer wg.Done()
 	for r := range ranges {
-		success := false
-		// TODO(alcutter): give up after a while:
-		for !success {
-			leaves, err := s.logClient.GetEntries(r.start, r.end)
+		chunk := &chunkResult{
+			start:     r.start,
+			matches:   make([]entryMatch, r.end-r.start+1),
+			remaining: int32(r.end - r.start + 1),
+		}
+		for r.start <= r.end {
+			leaves, err := s.fetchWithRetry(ctx, r.start, r.end)
 			if err != nil {
-				log.Printf("Problem fetching from log: %s", err.Error())
-				continue
+				errs <- fmt.Errorf("fetcher %d: %s", id, err.Error())
+				return
 			}
 			for _, leaf := range leaves {
-				entries <- matcherJob{leaf, r.start}
+				entries <- matcherJob{leaf, r.start, chunk, int(r.start - chunk.start)}
 				r.start++
 			}
-			if r.start > r.end {
-				// Only complete if we actually got all the leaves we were
-				// expecting -- Logs MAY return fewer than the number of
-				// leaves requested.
-				success = true
-			}
+			// If r.start <= r.end here, the log returned fewer leaves than
+			// requested -- loop around and fetch the remainder.
 		}
 	}
 	log.Printf("Fetcher %d finished", id)
-	wg.Done()
 }
 
 // Returns the smaller of |a| and |b|
@@ -180,6 +774,15 @@ func max(a int64, b int64) int64 {
 	}
 }
 
+// minDuration is min() for time.Duration, since Go won't let us reuse the
+// int64 overload above across types.
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // Pretty prints the passed in number of |seconds| into a more human readable
 // string.
 func humanTime(seconds int) string {
@@ -202,68 +805,191 @@ func humanTime(seconds int) string {
 	return s
 }
 
-// Performs a scan against the Log.
-// For each x509 certificate found, |foundCert| will be called with the
-// index of the entry and certificate itself as arguments.  For each precert
-// found, |foundPrecert| will be called with the index of the entry and the raw
-// precert string as the arguments.
-//
-// This method blocks until the scan is complete.
-func (s *Scanner) Scan(foundCert func(int64, *x509.Certificate), foundPrecert func(int64, string)) error {
-	log.Printf("Starting up...\n")
-	s.certsProcessed = 0
-	s.precertsSeen = 0
-
-	latestSth, err := s.logClient.GetSTH()
-	if err != nil {
-		return err
+// scanRange fetches and matches every entry in [start, end] (inclusive),
+// blocking until the range has been completely processed or |ctx| is
+// cancelled. It reports progress against s.certsProcessed exactly as Scan()
+// always has. foundCert/foundPrecert are invoked in strict log order -- a
+// chunk is never delivered before every chunk preceding it has been -- and
+// |onProgress|, if non-nil, is called with the index of the last entry
+// delivered once each chunk is fully flushed, so callers can checkpoint a
+// resumable StartIndex. If opts.VerifyInclusion is set, entries that fail
+// verification against opts.TrustedSTH are reported through foundInvalid
+// instead of foundCert/foundPrecert.
+func (s *Scanner) scanRange(ctx context.Context, start, end int64, foundCert func(int64, *x509.Certificate), foundPrecert func(int64, *x509.Certificate, []byte), foundInvalid func(int64, error), onProgress func(int64)) error {
+	var ranges list.List
+	numChunks := 0
+	for chunkStart := start; chunkStart <= end; {
+		chunkEnd := min(chunkStart+int64(s.opts.BlockSize), end)
+		ranges.PushBack(fetchRange{chunkStart, chunkEnd})
+		chunkStart = chunkEnd + 1
+		numChunks++
+	}
+	if numChunks == 0 {
+		return nil
 	}
-	log.Printf("Got STH with %d certs", latestSth.TreeSize)
 
-	ticker := time.NewTicker(time.Second)
-	startTime := time.Now()
-	go func() {
-		for _ = range ticker.C {
-			throughput := float64(s.certsProcessed) / time.Since(startTime).Seconds()
-			remainingCerts := int64(latestSth.TreeSize) - int64(s.opts.StartIndex) - s.certsProcessed
-			remainingSeconds := int(float64(remainingCerts) / throughput)
-			remainingString := humanTime(remainingSeconds)
-			fmt.Printf("Processed: %d certs (to index %d). Throughput: %3.2f ETA: %s\n",
-				s.certsProcessed, s.opts.StartIndex+int64(s.certsProcessed), throughput, remainingString)
-		}
-	}()
+	// scanCtx is cancelled either when |ctx| is, or as soon as a fetcher
+	// reports a hard failure, so that the rest of the pipeline doesn't keep
+	// grinding on a scan that's already doomed.
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	var ranges list.List
-	for start := s.opts.StartIndex; start < int64(latestSth.TreeSize); {
-		end := min(start+int64(s.opts.BlockSize), int64(latestSth.TreeSize)-1)
-		ranges.PushBack(fetchRange{start, end})
-		start = end + 1
-	}
+	dispatcher := newChunkDispatcher(start, numChunks)
 	fetches := make(chan fetchRange, 100)
 	jobs := make(chan matcherJob, 5000)
+	// Buffered for one slot per fetcher plus one for dispatchChunks, so
+	// that whichever goroutines hit a hard failure can report it and exit
+	// without blocking on a channel nobody but errDone's first receive is
+	// draining.
+	errs := make(chan error, s.opts.ParallelFetch+1)
 	var fetcherWG sync.WaitGroup
 	var matcherWG sync.WaitGroup
+	var dispatchWG sync.WaitGroup
+
+	dispatchWG.Add(1)
+	go func() {
+		defer dispatchWG.Done()
+		s.dispatchChunks(dispatcher, foundCert, foundPrecert, foundInvalid, onProgress, errs)
+	}()
 	// Start matcher workers
 	for w := 0; w < s.opts.NumWorkers; w++ {
 		matcherWG.Add(1)
-		go s.matcherJob(w, jobs, foundCert, foundPrecert, &matcherWG)
+		go s.matcherJob(w, jobs, dispatcher, &matcherWG)
 	}
 	// Start fetcher workers
 	for w := 0; w < s.opts.ParallelFetch; w++ {
 		fetcherWG.Add(1)
-		go s.fetcherJob(w, fetches, jobs, &fetcherWG)
+		go s.fetcherJob(scanCtx, w, fetches, jobs, errs, &fetcherWG)
 	}
+
+	var firstErr error
+	errDone := make(chan struct{})
+	go func() {
+		defer close(errDone)
+		if err, ok := <-errs; ok {
+			firstErr = err
+			// A fetcher gave up for good -- stop the rest of the scan
+			// instead of leaving it to hang waiting on chunks that will
+			// never arrive.
+			cancel()
+		}
+	}()
+
+feedLoop:
 	for r := ranges.Front(); r != nil; r = r.Next() {
-		fetches <- r.Value.(fetchRange)
+		select {
+		case fetches <- r.Value.(fetchRange):
+		case <-scanCtx.Done():
+			break feedLoop
+		}
 	}
 	close(fetches)
 	fetcherWG.Wait()
 	close(jobs)
 	matcherWG.Wait()
+	// Unblock the dispatcher in case not every chunk we promised it ever
+	// arrived.
+	dispatcher.cancel()
+	dispatchWG.Wait()
+	close(errs)
+	<-errDone
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Performs a scan against the Log.
+// For each x509 certificate found, |foundCert| will be called with the
+// index of the entry and certificate itself as arguments. For each precert
+// found, |foundPrecert| will be called with the index of the entry, the
+// reconstructed precert, and its raw (poison-stripped) TBSCertificate bytes.
+// If opts.PrecertOnly is set, X509 entries are skipped before they're even
+// parsed and foundCert is never called. If opts.VerifyInclusion is set,
+// |foundInvalid| is called instead of foundCert/foundPrecert for any entry
+// that fails verification against opts.TrustedSTH.
+//
+// This method blocks until the scan is complete, or |ctx| is cancelled.
+func (s *Scanner) Scan(ctx context.Context, foundCert func(int64, *x509.Certificate), foundPrecert func(int64, *x509.Certificate, []byte), foundInvalid func(int64, error)) error {
+	if err := s.validateOptions(); err != nil {
+		return err
+	}
+	log.Printf("Starting up...\n")
+	s.certsProcessed = 0
+	s.precertsSeen = 0
+
+	latestSth, err := s.logClient.GetSTH()
+	if err != nil {
+		return err
+	}
+	log.Printf("Got STH with %d certs", latestSth.TreeSize)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	startTime := time.Now()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				throughput := float64(s.certsProcessed) / time.Since(startTime).Seconds()
+				remainingCerts := int64(latestSth.TreeSize) - int64(s.opts.StartIndex) - s.certsProcessed
+				remainingSeconds := int(float64(remainingCerts) / throughput)
+				remainingString := humanTime(remainingSeconds)
+				fmt.Printf("Processed: %d certs (to index %d). Throughput: %3.2f ETA: %s\n",
+					s.certsProcessed, s.opts.StartIndex+int64(s.certsProcessed), throughput, remainingString)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = s.scanRange(ctx, s.opts.StartIndex, int64(latestSth.TreeSize)-1, foundCert, foundPrecert, foundInvalid, nil)
 
 	log.Printf("Completed %d certs in %s", s.certsProcessed, humanTime(int(time.Since(startTime).Seconds())))
 	log.Printf("Saw %d precerts", s.precertsSeen)
-	return nil
+	return err
+}
+
+// Tail continuously follows the Log, starting from s.opts.StartIndex.
+// It performs an initial scan up to the Log's current STH, and then polls
+// GetSTH() every |pollInterval| for growth, scanning any newly appended
+// entries as they show up. |foundCert|, |foundPrecert| and |foundInvalid|
+// are invoked exactly as they are for Scan(), strictly in log order.
+// |onProgress| (if non-nil) is called with the index of the last entry known
+// to have been delivered as soon as each underlying chunk is flushed, so
+// that callers can persist it and pass it back in as StartIndex to resume a
+// Tail() after a restart.
+//
+// Tail only returns when |ctx| is cancelled, or an unrecoverable error
+// occurs talking to the Log.
+func (s *Scanner) Tail(ctx context.Context, pollInterval time.Duration, foundCert func(int64, *x509.Certificate), foundPrecert func(int64, *x509.Certificate, []byte), foundInvalid func(int64, error), onProgress func(int64)) error {
+	if err := s.validateOptions(); err != nil {
+		return err
+	}
+	next := s.opts.StartIndex
+	for {
+		sth, err := s.logClient.GetSTH()
+		if err != nil {
+			return err
+		}
+		if end := int64(sth.TreeSize) - 1; end >= next {
+			if err := s.scanRange(ctx, next, end, foundCert, foundPrecert, foundInvalid, onProgress); err != nil {
+				return err
+			}
+			next = end + 1
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
 }
 
 // Creates a new Scanner instance using |client| to talk to the log, and taking
@@ -277,4 +1003,4 @@ func NewScanner(client *client.LogClient, opts ScannerOptions) *Scanner {
 	}
 	scanner.opts = opts
 	return &scanner
-}
\ No newline at end of file
+}
@@ -0,0 +1,359 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"ct"
+	"ct/client"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testMTH computes the RFC 6962 section 2.1 Merkle Tree Hash of |leaves|,
+// recursively and independently of compactMerkleTree, so it can be used to
+// cross-check that type's incremental result.
+func testMTH(leaves [][32]byte) [32]byte {
+	n := len(leaves)
+	if n == 0 {
+		return sha256.Sum256(nil)
+	}
+	if n == 1 {
+		return leaves[0]
+	}
+	k := largestPowerOfTwoLessThan(n)
+	return rfc6962NodeHash(testMTH(leaves[:k]), testMTH(leaves[k:]))
+}
+
+// largestPowerOfTwoLessThan returns the largest power of two strictly
+// smaller than |n|, as used throughout RFC 6962 section 2.1's tree shape
+// definitions.
+func largestPowerOfTwoLessThan(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// testConsistencyProof builds the RFC 6962 section 2.1.2 consistency proof
+// between the first |m| of |leaves| and all of |leaves|, independently of
+// anything in scanner.go, so it can be fed into verifyConsistency as a
+// known-good input. Returns nil for m == 0, matching verifyConsistency's own
+// special-cased handling of the empty tree.
+func testConsistencyProof(m int, leaves [][32]byte) [][]byte {
+	if m == 0 {
+		return nil
+	}
+	hashes := subProof(m, leaves, true)
+	proof := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		h := h
+		proof[i] = h[:]
+	}
+	return proof
+}
+
+// subProof is RFC 6962 section 2.1.2's SUBPROOF(m, D[n], boundaryIsNode).
+func subProof(m int, leaves [][32]byte, boundaryIsNode bool) [][32]byte {
+	n := len(leaves)
+	if m == n {
+		if boundaryIsNode {
+			return nil
+		}
+		return [][32]byte{testMTH(leaves)}
+	}
+	k := largestPowerOfTwoLessThan(n)
+	if m <= k {
+		return append(subProof(m, leaves[:k], boundaryIsNode), testMTH(leaves[k:]))
+	}
+	return append(subProof(m-k, leaves[k:], false), testMTH(leaves[:k]))
+}
+
+// testLeaves returns |n| distinct RFC 6962 leaf hashes.
+func testLeaves(n int) [][32]byte {
+	leaves := make([][32]byte, n)
+	for i := range leaves {
+		leaves[i] = rfc6962LeafHash(client.LeafInput{byte(i), byte(i >> 8)})
+	}
+	return leaves
+}
+
+func TestVerifyConsistencyAcceptsValidProofs(t *testing.T) {
+	for n := 1; n <= 40; n++ {
+		leaves := testLeaves(n)
+		root2 := testMTH(leaves)
+		for m := 1; m <= n; m++ {
+			root1 := testMTH(leaves[:m])
+			proof := testConsistencyProof(m, leaves)
+			if err := verifyConsistency(int64(m), int64(n), root1, root2, proof); err != nil {
+				t.Errorf("verifyConsistency(%d, %d, ...) = %v, want nil", m, n, err)
+			}
+		}
+		// The empty tree is consistent with everything, trivially.
+		if err := verifyConsistency(0, int64(n), [32]byte{}, root2, nil); err != nil {
+			t.Errorf("verifyConsistency(0, %d, ...) = %v, want nil", n, err)
+		}
+	}
+}
+
+func TestVerifyConsistencyRejectsTamperedProof(t *testing.T) {
+	leaves := testLeaves(10)
+	root1 := testMTH(leaves[:4])
+	root2 := testMTH(leaves)
+	proof := testConsistencyProof(4, leaves)
+	if len(proof) == 0 {
+		t.Fatal("expected a non-empty proof for (4, 10)")
+	}
+	proof[0][0] ^= 0xff
+	if err := verifyConsistency(4, 10, root1, root2, proof); err == nil {
+		t.Error("verifyConsistency accepted a tampered proof, want an error")
+	}
+}
+
+func TestVerifyConsistencyRejectsWrongRoots(t *testing.T) {
+	leaves := testLeaves(10)
+	proof := testConsistencyProof(4, leaves)
+	var wrongRoot [32]byte
+	if err := verifyConsistency(4, 10, wrongRoot, testMTH(leaves), proof); err == nil {
+		t.Error("verifyConsistency accepted a wrong old root, want an error")
+	}
+	if err := verifyConsistency(4, 10, testMTH(leaves[:4]), wrongRoot, proof); err == nil {
+		t.Error("verifyConsistency accepted a wrong new root, want an error")
+	}
+}
+
+func TestValidateOptionsRejectsMissingTrustedSTH(t *testing.T) {
+	s := NewScanner(nil, ScannerOptions{VerifyInclusion: true})
+	if err := s.validateOptions(); err == nil {
+		t.Error("validateOptions() = nil with VerifyInclusion set and no TrustedSTH, want an error")
+	}
+}
+
+func TestValidateOptionsRejectsVerifyInclusionWithStartIndex(t *testing.T) {
+	sth := &ct.SignedTreeHead{}
+	s := NewScanner(nil, ScannerOptions{VerifyInclusion: true, TrustedSTH: sth, StartIndex: 100})
+	if err := s.validateOptions(); err == nil {
+		t.Error("validateOptions() = nil with VerifyInclusion set and a non-zero StartIndex, want an error")
+	}
+}
+
+// testTBSCertificateDER builds a real, self-signed TBSCertificate DER with
+// the given serial number and a critical CT poison extension, as a CA would
+// submit to get an SCT for a precertificate.
+func testTBSCertificateDER(t *testing.T, serial int64) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("precert-%d.example.com", serial)},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).AddDate(1, 0, 0),
+		ExtraExtensions: []pkix.Extension{
+			{Id: ctPoisonOID, Critical: true, Value: []byte{0x05, 0x00}}, // ASN.1 NULL
+		},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create precertificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("failed to parse precertificate: %s", err)
+	}
+	return cert.RawTBSCertificate
+}
+
+// TestParsePrecertRoundTrip builds a real precertificate TBSCertificate
+// carrying the CT poison extension, strips it, and reconstructs a
+// certificate via parsePrecert, checking that the result matches the
+// original and that the poison extension is actually gone.
+func TestParsePrecertRoundTrip(t *testing.T) {
+	rawTBS := testTBSCertificateDER(t, 424242)
+
+	stripped, err := stripPoisonExtension(rawTBS)
+	if err != nil {
+		t.Fatalf("stripPoisonExtension() = %v, want nil error", err)
+	}
+	var strippedTBS tbsCertificate
+	if _, err := asn1.Unmarshal(stripped, &strippedTBS); err != nil {
+		t.Fatalf("failed to re-parse stripped TBSCertificate: %s", err)
+	}
+	for _, ext := range strippedTBS.Extensions {
+		if ext.Id.Equal(ctPoisonOID) {
+			t.Error("stripPoisonExtension() left the poison extension in place")
+		}
+	}
+
+	issuerKeyHash := [32]byte{1, 2, 3, 4}
+	cert, tbs, err := parsePrecert(client.PreCert{IssuerKeyHash: issuerKeyHash, TBSCertificate: rawTBS})
+	if err != nil {
+		t.Fatalf("parsePrecert() = %v, want nil error", err)
+	}
+	if cert.SerialNumber.Int64() != 424242 {
+		t.Errorf("reconstructed cert SerialNumber = %v, want 424242", cert.SerialNumber)
+	}
+	if cert.Subject.CommonName != "precert-424242.example.com" {
+		t.Errorf("reconstructed cert CommonName = %q, want %q", cert.Subject.CommonName, "precert-424242.example.com")
+	}
+	if !bytes.Equal(cert.AuthorityKeyId, issuerKeyHash[:]) {
+		t.Errorf("reconstructed cert AuthorityKeyId = %x, want %x", cert.AuthorityKeyId, issuerKeyHash)
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(ctPoisonOID) {
+			t.Error("reconstructed certificate still carries the poison extension")
+		}
+	}
+	if !bytes.Equal(tbs, stripped) {
+		t.Error("parsePrecert()'s returned raw TBS doesn't match stripPoisonExtension()'s own output")
+	}
+}
+
+// writeUint24 appends a 3-byte big-endian length, as used throughout the
+// RFC 6962 section 3.4 MerkleTreeLeaf encoding for opaque<1..2^24-1> fields.
+func writeUint24(buf *bytes.Buffer, v int) {
+	buf.WriteByte(byte(v >> 16))
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v))
+}
+
+// testX509LeafInput builds the RFC 6962 section 3.4 MerkleTreeLeaf encoding
+// for an X509LogEntryType entry wrapping |certDER|, i.e. the raw LeafInput a
+// log's get-entries response would carry for it.
+func testX509LeafInput(certDER []byte, timestamp uint64) client.LeafInput {
+	var buf bytes.Buffer
+	buf.WriteByte(0)                                // version: v1
+	buf.WriteByte(0)                                // leaf_type: timestamped_entry
+	binary.Write(&buf, binary.BigEndian, timestamp) // timestamp
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // entry_type: x509_entry
+	writeUint24(&buf, len(certDER))                 // ASN.1Cert length
+	buf.Write(certDER)                              // ASN.1Cert
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // CtExtensions: none
+	return client.LeafInput(buf.Bytes())
+}
+
+// testLeafCert builds a minimal, self-signed, parseable certificate with the
+// given serial number, for use as fake log content.
+func testLeafCert(t *testing.T, serial int64) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("leaf-%d.example.com", serial)},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).AddDate(1, 0, 0),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create leaf certificate: %s", err)
+	}
+	return certDER
+}
+
+// fakeLogClient serves a fixed, in-memory list of leaves, as a stand-in for
+// *client.LogClient in tests that need to drive scanRange without a real
+// network connection. It only implements GetEntries out of logClientAPI,
+// since the tests that use it call scanRange directly (which never calls
+// GetSTH) with VerifyInclusion (the only user of GetSTHConsistency) off.
+type fakeLogClient struct {
+	leaves []client.LeafInput
+}
+
+func (f *fakeLogClient) GetEntries(start, end int64) ([]client.LeafInput, error) {
+	if start < 0 || start >= int64(len(f.leaves)) {
+		return nil, fmt.Errorf("start index %d out of range", start)
+	}
+	if end >= int64(len(f.leaves)) {
+		end = int64(len(f.leaves)) - 1
+	}
+	return append([]client.LeafInput{}, f.leaves[start:end+1]...), nil
+}
+
+func (f *fakeLogClient) GetSTH() (*ct.SignedTreeHead, error) {
+	return nil, fmt.Errorf("fakeLogClient: GetSTH not implemented")
+}
+
+func (f *fakeLogClient) GetSTHConsistency(first, second int64) ([][]byte, error) {
+	return nil, fmt.Errorf("fakeLogClient: GetSTHConsistency not implemented")
+}
+
+// TestScanRangeDeliversInStrictOrderWithCheckpoints drives scanRange over a
+// fake log with multiple chunks and fetchers, and checks that -- despite
+// fetches and matches completing in whatever order the workers happen to
+// finish them -- entries are still delivered to foundCert in strict log
+// order, and onProgress never reports a checkpoint out of order or short of
+// the final index.
+func TestScanRangeDeliversInStrictOrderWithCheckpoints(t *testing.T) {
+	const numEntries = 13
+	leaves := make([]client.LeafInput, numEntries)
+	for i := 0; i < numEntries; i++ {
+		leaves[i] = testX509LeafInput(testLeafCert(t, int64(i)), uint64(i))
+	}
+
+	s := &Scanner{
+		logClient: &fakeLogClient{leaves: leaves},
+		opts: ScannerOptions{
+			Matcher:       &MatchAll{},
+			BlockSize:     3,
+			NumWorkers:    4,
+			ParallelFetch: 4,
+		},
+	}
+
+	var delivered []int64
+	foundCert := func(index int64, cert *x509.Certificate) {
+		if cert.SerialNumber.Int64() != index {
+			t.Errorf("foundCert(%d, ...) got a cert with serial %v, want %d", index, cert.SerialNumber, index)
+		}
+		delivered = append(delivered, index)
+	}
+	foundPrecert := func(int64, *x509.Certificate, []byte) {}
+	foundInvalid := func(index int64, err error) {
+		t.Errorf("foundInvalid(%d, %v), want no invalid entries", index, err)
+	}
+
+	var progress []int64
+	onProgress := func(through int64) { progress = append(progress, through) }
+
+	if err := s.scanRange(context.Background(), 0, numEntries-1, foundCert, foundPrecert, foundInvalid, onProgress); err != nil {
+		t.Fatalf("scanRange() = %v, want nil", err)
+	}
+
+	if len(delivered) != numEntries {
+		t.Fatalf("delivered %d entries, want %d", len(delivered), numEntries)
+	}
+	for i, index := range delivered {
+		if index != int64(i) {
+			t.Errorf("delivered[%d] = %d, want %d -- entries were not delivered in strict log order", i, index, i)
+		}
+	}
+
+	if len(progress) == 0 {
+		t.Fatal("onProgress was never called")
+	}
+	last := int64(-1)
+	for _, through := range progress {
+		if through <= last {
+			t.Errorf("onProgress checkpoints went from %d to %d, want strictly increasing", last, through)
+		}
+		last = through
+	}
+	if last != numEntries-1 {
+		t.Errorf("final onProgress checkpoint = %d, want %d", last, numEntries-1)
+	}
+}